@@ -4,13 +4,19 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
 	"strconv"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
@@ -19,19 +25,53 @@ import (
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cflags "-Wall -Wextra -g -O2" bpf proxy-sockmap.c -- -I/usr/src/linux/include
 
+var (
+	routesFile      = flag.String("routes", "routes.yaml", "path to the SNI route table (YAML or JSON)")
+	adminSock       = flag.String("admin-socket", "", "optional unix socket path for triggering a route table reload")
+	metricsAddr     = flag.String("metrics-addr", ":9090", "address to serve /metrics on")
+	quicAddr        = flag.String("quic-addr", ":443", "UDP address for the HTTP/3 (QUIC) listener")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight connections to drain on SIGTERM/SIGINT")
+)
+
+// traceSeq generates per-connection trace IDs. It is only ever incremented,
+// so connections from a single process get monotonically increasing,
+// easily greppable IDs rather than colliding random ones.
+var traceSeq uint64
+
+func nextTraceID() string {
+	return fmt.Sprintf("c%d", atomic.AddUint64(&traceSeq, 1))
+}
+
 func main() {
+	flag.Parse()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	StartMetricsServer(*metricsAddr)
+
+	table, err := LoadRouteTable(*routesFile)
+	if err != nil {
+		slog.Error("loading route table", "error", err)
+		os.Exit(1)
+	}
+	watchReloadSignals(table)
+	if *adminSock != "" {
+		if err := serveAdminSocket(*adminSock, table); err != nil {
+			slog.Error("serving admin socket", "error", err)
+			os.Exit(1)
+		}
+	}
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
-		log.Fatal(err)
+		slog.Error("removing memlock limit", "error", err)
+		os.Exit(1)
 	}
 
 	// Load pre-compiled programs and maps into the kernel.
 	objs := bpfObjects{}
 	if err := loadBpfObjects(&objs, nil); err != nil {
-		log.Fatalf("loading objects: %v", err)
+		slog.Error("loading eBPF objects", "error", err)
+		os.Exit(1)
 	}
-	defer objs.Close()
-	var err error
 
 	err = link.RawAttachProgram(link.RawAttachProgramOptions{
 		Target:  objs.HashMap.FD(),
@@ -39,7 +79,8 @@ func main() {
 		Attach:  ebpf.AttachSkSKBStreamVerdict,
 	})
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("attaching verdict program", "error", err)
+		os.Exit(1)
 	}
 
 	err = link.RawAttachProgram(link.RawAttachProgramOptions{
@@ -48,102 +89,161 @@ func main() {
 		Attach:  ebpf.AttachSkSKBStreamParser,
 	})
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("attaching parser program", "error", err)
+		os.Exit(1)
 	}
 
 	// Launch local "nc" on port 8080
 	go nc()
 
+	// The QUIC listener reuses the same SNI route table and upstream
+	// pools as the TCP/kTLS path; sockmap does not apply to UDP, so it
+	// falls back to a userspace splice (see quic.go).
+	if err := ServeQUIC(*quicAddr, table); err != nil {
+		slog.Error("starting QUIC listener", "error", err)
+		os.Exit(1)
+	}
+
 	addrLn, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", 443))
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("resolving listen address", "error", err)
+		os.Exit(1)
 	}
 
 	listener, err := net.ListenTCP("tcp", addrLn)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("listening", "error", err)
+		os.Exit(1)
 	}
-	defer listener.Close()
 
-	for {
-		// ACCEPT CONNECTION
-		inconn, err := listener.AcceptTCP()
-		if err != nil {
-			log.Fatal(err)
-		}
-		go HandleConn(inconn, objs.HashMap)
-	}
+	proxy := NewProxy(listener, &objs, table)
+	go proxy.Serve()
+
+	WaitForShutdownSignal()
+	slog.Info("shutdown signal received, draining connections", "timeout", *shutdownTimeout)
+	proxy.Shutdown(*shutdownTimeout)
 }
 
-func HandleConn(inconn *net.TCPConn, hashMap *ebpf.Map) {
+func HandleConn(inconn *net.TCPConn, hashMap *ebpf.Map, table *RouteTable) {
+	start := time.Now()
+	traceID := nextTraceID()
+	logger := slog.With("trace_id", traceID, "remote_addr", inconn.RemoteAddr().String())
+
 	var events [32]syscall.EpollEvent
 	epfd, err := syscall.EpollCreate1(0)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("epoll_create1", "error", err)
+		return
 	}
 	defer syscall.Close(epfd)
 
-	config := &tls.Config{}
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair("./cert.pem", "./key.pem")
+	// Peek the ClientHello to learn the SNI host before terminating TLS,
+	// since the chosen upstream and certificate both depend on it.
+	br := bufio.NewReader(inconn)
+	sni, _, peeked, err := clientHelloServerName(br)
 	if err != nil {
-		log.Fatal(err)
+		logger.Warn("SNI sniff failed", "error", err)
+		return
+	}
+	conn := &Conn{Peeked: []byte(peeked), Conn: inconn}
+	logger = logger.With("sni", sni)
+
+	r, err := table.Lookup(sni)
+	if err != nil {
+		logger.Warn("routing failed", "error", err)
+		conn.Close()
+		return
 	}
 
-	server := tls.Server(inconn, config)
+	// This listener only ever speaks raw TLS + kTLS-spliced bytes, never
+	// QUIC/HTTP-3 framing, so it must not advertise "h3" the way the QUIC
+	// listener in quic.go does.
+	config := &tls.Config{GetCertificate: table.GetCertificate, NextProtos: []string{"http/1.1"}}
+
+	server := tls.Server(conn, config)
 	err = server.Handshake()
 	if err != nil {
-		log.Println("Handshake", err)
+		metricHandshakeFailures.Inc()
+		logger.Warn("TLS handshake failed", "error", err)
 		return
 	}
+	metricHandshakeDuration.Observe(time.Since(start).Seconds())
 
 	// DIAL + UPDATE SOCK MAP
-	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	outconn, target, err := r.pool.Dial()
 	if err != nil {
-		log.Fatal(err)
+		logger.Warn("dialing upstream failed", "error", err)
+		conn.Close()
+		return
+	}
+	defer target.Release()
+
+	ofd, err := getFD(outconn)
+	if err != nil {
+		logger.Error("getting outbound fd", "error", err)
+		conn.Close()
+		outconn.Close()
+		return
 	}
-	outconn, err := net.DialTCP("tcp", nil, addr)
+	ifd, err := getFD(inconn)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("getting inbound fd", "error", err)
+		conn.Close()
+		outconn.Close()
+		return
 	}
 
-	ofd := getFD(outconn)
-	ifd := getFD(inconn)
+	// The sockmap key is derived from this connection's local/remote
+	// ports (see getKey); logging it alongside trace_id is what lets an
+	// operator correlate this line with a `bpftool map dump` entry.
+	logger = logger.With("sockmap_key_in", getKey(inconn), "sockmap_key_out", getKey(outconn))
 
 	err = hashMap.Update(getKey(outconn), uint32(ifd), ebpf.UpdateAny)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("sockmap update (outbound)", "error", err)
+		conn.Close()
+		outconn.Close()
+		return
 	}
+	metricSockmapInserts.Inc()
 
 	err = hashMap.Update(getKey(inconn), uint32(ofd), ebpf.UpdateAny)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("sockmap update (inbound)", "error", err)
+		hashMap.Delete(getKey(outconn))
+		conn.Close()
+		outconn.Close()
+		return
 	}
+	metricSockmapInserts.Inc()
+	metricActiveConns.Inc()
+	defer metricActiveConns.Dec()
 
 	err = syscall.SetsockoptString(int(ifd), syscall.SOL_TCP, TCP_ULP, "tls")
 	if err != nil {
-		log.Println("kTLS: setsockopt(SOL_TCP, TCP_ULP) failed:", err)
+		logger.Warn("kTLS setsockopt(SOL_TCP, TCP_ULP) failed", "error", err)
 	}
 
-	err = kTLSEnable(server, TLS_TX)
-	if err != nil {
-		log.Fatal("ktls", err)
+	if err := kTLSEnable(server, TLS_TX); err != nil {
+		metricKTLSFailures.WithLabelValues("tx").Inc()
+		logger.Error("kTLS enable (tx) failed", "error", err)
+		return
 	}
 
-	err = kTLSEnable(server, TLS_RX)
-	if err != nil {
-		log.Fatal("ktls", err)
+	if err := kTLSEnable(server, TLS_RX); err != nil {
+		metricKTLSFailures.WithLabelValues("rx").Inc()
+		logger.Error("kTLS enable (rx) failed", "error", err)
+		return
 	}
 
-	//
 	err = syscall.SetsockoptInt(int(ifd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 6553500)
 	if err != nil {
-		log.Println("kTLS: setsockopt(SOL_SOCKET, SNDBUF) failed:", err)
+		logger.Warn("setsockopt(SOL_SOCKET, SNDBUF) failed", "error", err)
 	}
 
 	err = syscall.SetsockoptInt(int(ifd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 6553500)
 	if err != nil {
-		log.Println("kTLS: setsockopt(SOL_SOCKET, SNDBUF) failed:", err)
+		logger.Warn("setsockopt(SOL_SOCKET, RCVBUF) failed", "error", err)
 	}
 
 	go func() {
@@ -151,23 +251,27 @@ func HandleConn(inconn *net.TCPConn, hashMap *ebpf.Map) {
 		for {
 			n, err := inconn.Read(b)
 			if err != nil {
-				// log.Println(err)
 				return
 			}
 			_ = n
 		}
 	}()
 
-	// Use epoll(7) to wait connection close (TODO: add outconn close to events)
-	event := syscall.EpollEvent{Events: syscall.EPOLLRDHUP, Fd: int32(ifd)}
-	for i := 0; i < 5; i++ {
-		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, int(ifd), &event)
-		if err == nil {
-			break
+	// Use epoll(7) to wait for either side to close: the inbound fd for
+	// client-initiated closes, and the outbound fd so a backend-initiated
+	// close is detected too instead of leaking the sockmap entries.
+	for _, fd := range []int32{int32(ifd), int32(ofd)} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLRDHUP, Fd: fd}
+		for i := 0; i < 5; i++ {
+			err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, int(fd), &event)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Error("epoll_ctl", "error", err)
+			return
 		}
-	}
-	if err != nil {
-		log.Fatal(err)
 	}
 
 	for {
@@ -177,30 +281,31 @@ func HandleConn(inconn *net.TCPConn, hashMap *ebpf.Map) {
 		}
 		errno, ok := err.(syscall.Errno)
 		if !ok || errno != syscall.EINTR {
-			log.Fatal(err)
+			logger.Error("epoll_wait", "error", err)
+			return
 		}
-		log.Println("interrupted syscall, retry")
-	}
-	if err != nil {
-		log.Fatal(err)
+		logger.Debug("interrupted syscall, retry")
 	}
 	hashMap.Delete(getKey(inconn))
 	hashMap.Delete(getKey(outconn))
+	metricSockmapDeletes.Add(2)
 	inconn.Close()
 	outconn.Close()
+	metricConnDuration.Observe(time.Since(start).Seconds())
+	logger.Info("connection closed")
 }
 
-func getFD(conn *net.TCPConn) uintptr {
+func getFD(conn *net.TCPConn) (uintptr, error) {
 	rawConn, err := conn.SyscallConn()
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	var connfd uintptr
 	err = rawConn.Control(func(fd uintptr) { connfd = fd })
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	return connfd
+	return connfd, nil
 }
 
 func getKey(conn *net.TCPConn) uint64 {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricAcceptedConns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_accepted_connections_total",
+		Help: "Total number of TCP connections accepted by the proxy.",
+	})
+	metricHandshakeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_tls_handshake_failures_total",
+		Help: "Total number of TLS handshakes that failed.",
+	})
+	metricKTLSFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_ktls_setsockopt_failures_total",
+		Help: "Total number of kTLS setsockopt(2) calls that failed, by direction.",
+	}, []string{"direction"})
+	metricSockmapInserts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_sockmap_inserts_total",
+		Help: "Total number of entries inserted into the sockmap.",
+	})
+	metricSockmapDeletes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_sockmap_deletes_total",
+		Help: "Total number of entries deleted from the sockmap.",
+	})
+	metricActiveConns = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_active_connections",
+		Help: "Number of connections currently spliced through the sockmap.",
+	})
+	metricHandshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_tls_handshake_duration_seconds",
+		Help:    "Time spent performing the inbound TLS handshake.",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricConnDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_connection_duration_seconds",
+		Help:    "Lifetime of a spliced connection, from accept to teardown.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	// metricSNIBytes is only populated from the QUIC splice path
+	// (spliceQUICStream in quic.go), where bytes genuinely pass through a
+	// userspace io.Copy and can be counted. The TCP/kTLS listener hands
+	// connections to the kernel sockmap precisely so bytes stop passing
+	// through userspace at all; getting a per-SNI count there would need
+	// an eBPF-side PERCPU_HASH counter keyed off SNI in the verdict
+	// program, which doesn't exist in this tree and is out of scope for a
+	// pure-Go change. Treat this metric as QUIC-only until that lands.
+	metricSNIBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_sni_bytes_total",
+		Help: "Total bytes spliced per SNI host and direction on the QUIC listener. The TCP/kTLS path is not counted; see source comment.",
+	}, []string{"sni", "direction"})
+)
+
+// StartMetricsServer exposes the Prometheus metrics above, plus the
+// expvar debug vars the Go runtime registers (memstats, cmdline, etc.),
+// on addr, e.g. ":9090". It runs until the process exits.
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolUnavailable is returned when every target in a pool is currently
+// marked unhealthy, so HandleConn can close the accepted TLS connection
+// cleanly instead of crashing the daemon.
+var ErrPoolUnavailable = errors.New("pool: no healthy upstream available")
+
+// Policy picks which target in a pool serves the next connection.
+type Policy string
+
+const (
+	PolicyRoundRobin       Policy = "round-robin"
+	PolicyLeastConnections Policy = "least-connections"
+	PolicyWeightedRandom   Policy = "weighted-random"
+
+	defaultBackoff    = time.Second
+	maxBackoff        = time.Minute
+	defaultHCInterval = 5 * time.Second
+	defaultHCTimeout  = 2 * time.Second
+)
+
+// Target is a single upstream host:port within a Pool, along with its
+// static weight and live health/connection state.
+type Target struct {
+	Addr   string
+	Weight int
+
+	mu      sync.Mutex
+	healthy bool
+	backoff time.Duration
+	nextTry time.Time
+
+	conns int64 // active connections, for the least-connections policy
+}
+
+func newTarget(addr string, weight int) *Target {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Target{Addr: addr, Weight: weight, healthy: true, backoff: defaultBackoff}
+}
+
+// Healthy reports whether the target should currently be considered for
+// new connections.
+func (t *Target) Healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.healthy {
+		return true
+	}
+	// Allow a target back into rotation once its backoff has elapsed,
+	// optimistically; the health checker (or the next failed dial) will
+	// mark it down again if it is still bad.
+	return !t.nextTry.IsZero() && time.Now().After(t.nextTry)
+}
+
+// markDown marks the target unhealthy and schedules the next retry with
+// exponential backoff, capped at maxBackoff.
+func (t *Target) markDown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = false
+	t.nextTry = time.Now().Add(t.backoff)
+	t.backoff *= 2
+	if t.backoff > maxBackoff {
+		t.backoff = maxBackoff
+	}
+}
+
+// markUp clears the unhealthy state and resets the backoff.
+func (t *Target) markUp() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = true
+	t.backoff = defaultBackoff
+	t.nextTry = time.Time{}
+}
+
+func (t *Target) addConn(delta int64) {
+	atomic.AddInt64(&t.conns, delta)
+}
+
+// Pool is a set of upstream targets for a route, dialed according to a
+// selection Policy. It is safe for concurrent use.
+type Pool struct {
+	targets []*Target
+	policy  Policy
+	rrIdx   uint64
+}
+
+// NewPool builds a Pool from targets, defaulting to round-robin if policy
+// is empty or unrecognised.
+func NewPool(targets []*Target, policy Policy) *Pool {
+	switch policy {
+	case PolicyRoundRobin, PolicyLeastConnections, PolicyWeightedRandom:
+	default:
+		policy = PolicyRoundRobin
+	}
+	return &Pool{targets: targets, policy: policy}
+}
+
+func (p *Pool) healthyTargets() []*Target {
+	healthy := make([]*Target, 0, len(p.targets))
+	for _, t := range p.targets {
+		if t.Healthy() {
+			healthy = append(healthy, t)
+		}
+	}
+	return healthy
+}
+
+func (p *Pool) pick() *Target {
+	healthy := p.healthyTargets()
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case PolicyLeastConnections:
+		best := healthy[0]
+		for _, t := range healthy[1:] {
+			if atomic.LoadInt64(&t.conns) < atomic.LoadInt64(&best.conns) {
+				best = t
+			}
+		}
+		return best
+
+	case PolicyWeightedRandom:
+		total := 0
+		for _, t := range healthy {
+			total += t.Weight
+		}
+		n := rand.Intn(total)
+		for _, t := range healthy {
+			n -= t.Weight
+			if n < 0 {
+				return t
+			}
+		}
+		return healthy[len(healthy)-1]
+
+	default: // PolicyRoundRobin
+		idx := atomic.AddUint64(&p.rrIdx, 1)
+		return healthy[int(idx)%len(healthy)]
+	}
+}
+
+// Dial picks a healthy target and dials it, retrying the remaining
+// healthy targets (passive marking) if the dial fails. It returns
+// ErrPoolUnavailable, never log.Fatal, so a bad pool cannot crash the
+// daemon; the caller is expected to close the accepted connection.
+func (p *Pool) Dial() (*net.TCPConn, *Target, error) {
+	healthy := p.healthyTargets()
+	if len(healthy) == 0 {
+		return nil, nil, ErrPoolUnavailable
+	}
+
+	tried := make(map[*Target]bool, len(healthy))
+	for len(tried) < len(healthy) {
+		target := p.pick()
+		if target == nil || tried[target] {
+			// pick() landed on an already-tried target because the
+			// healthy set shrank concurrently; fall back to a linear
+			// scan of what's left.
+			target = firstUntried(healthy, tried)
+			if target == nil {
+				break
+			}
+		}
+		tried[target] = true
+
+		addr, err := net.ResolveTCPAddr("tcp", target.Addr)
+		if err != nil {
+			target.markDown()
+			continue
+		}
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			target.markDown()
+			continue
+		}
+		target.markUp()
+		target.addConn(1)
+		return conn, target, nil
+	}
+	return nil, nil, ErrPoolUnavailable
+}
+
+// Release decrements the in-flight connection count used by the
+// least-connections policy. Call it once the dialed connection closes.
+func (t *Target) Release() {
+	t.addConn(-1)
+}
+
+func firstUntried(targets []*Target, tried map[*Target]bool) *Target {
+	for _, t := range targets {
+		if !tried[t] {
+			return t
+		}
+	}
+	return nil
+}
+
+// Duration parses from both JSON and YAML as a Go duration string
+// ("5s", "500ms"), unlike the bare time.Duration the standard decoders
+// only accept as a number of nanoseconds.
+type Duration time.Duration
+
+// UnmarshalYAML accepts a duration string such as "5s".
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalJSON accepts a duration string such as "5s".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	s = s[1 : len(s)-1] // strip surrounding quotes
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// HealthCheckConfig configures the active checker for a pool.
+type HealthCheckConfig struct {
+	// Type is "tcp" (connect only) or "http" (GET Path and require 2xx).
+	Type     string   `json:"type" yaml:"type"`
+	Path     string   `json:"path" yaml:"path"`
+	Interval Duration `json:"interval" yaml:"interval"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+}
+
+// startHealthChecker launches a goroutine that periodically probes every
+// target in the pool and marks it up/down based on the result. It runs
+// until stop is closed.
+func startHealthChecker(pool *Pool, cfg HealthCheckConfig, stop <-chan struct{}) {
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = defaultHCInterval
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHCTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				for _, t := range pool.targets {
+					checkTarget(t, cfg, timeout)
+				}
+			}
+		}
+	}()
+}
+
+func checkTarget(t *Target, cfg HealthCheckConfig, timeout time.Duration) {
+	var err error
+	if cfg.Type == "http" {
+		err = checkHTTP(t.Addr, cfg.Path, timeout)
+	} else {
+		err = checkTCP(t.Addr, timeout)
+	}
+
+	if err != nil {
+		t.markDown()
+		return
+	}
+	t.markUp()
+}
+
+func checkTCP(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkHTTP(addr, path string, timeout time.Duration) error {
+	if path == "" {
+		path = "/healthz"
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s%s", addr, path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
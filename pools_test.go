@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTargetBackoffStateMachine(t *testing.T) {
+	target := newTarget("127.0.0.1:0", 1)
+	if !target.Healthy() {
+		t.Fatal("newTarget should start healthy")
+	}
+
+	target.markDown()
+	if target.Healthy() {
+		t.Fatal("target should be unhealthy immediately after markDown")
+	}
+	if target.backoff != 2*defaultBackoff {
+		t.Errorf("backoff after first markDown = %v, want %v", target.backoff, 2*defaultBackoff)
+	}
+
+	target.markDown()
+	if target.backoff != 4*defaultBackoff {
+		t.Errorf("backoff after second markDown = %v, want %v", target.backoff, 4*defaultBackoff)
+	}
+
+	target.markUp()
+	if !target.Healthy() {
+		t.Fatal("target should be healthy after markUp")
+	}
+	if target.backoff != defaultBackoff {
+		t.Errorf("backoff after markUp = %v, want reset to %v", target.backoff, defaultBackoff)
+	}
+}
+
+func TestTargetBackoffCapsAtMax(t *testing.T) {
+	target := newTarget("127.0.0.1:0", 1)
+	for i := 0; i < 20; i++ {
+		target.markDown()
+	}
+	if target.backoff != maxBackoff {
+		t.Errorf("backoff = %v, want capped at %v", target.backoff, maxBackoff)
+	}
+}
+
+func TestTargetHealthyAfterBackoffElapses(t *testing.T) {
+	target := newTarget("127.0.0.1:0", 1)
+	target.markDown()
+	target.mu.Lock()
+	target.nextTry = time.Now().Add(-time.Second) // force backoff to have elapsed
+	target.mu.Unlock()
+
+	if !target.Healthy() {
+		t.Fatal("target should be optimistically healthy once its backoff has elapsed")
+	}
+}
+
+func TestPoolPickRoundRobinCyclesAllHealthyTargets(t *testing.T) {
+	targets := []*Target{
+		newTarget("127.0.0.1:1", 1),
+		newTarget("127.0.0.1:2", 1),
+		newTarget("127.0.0.1:3", 1),
+	}
+	pool := NewPool(targets, PolicyRoundRobin)
+
+	seen := make(map[*Target]bool)
+	for i := 0; i < len(targets)*2; i++ {
+		seen[pool.pick()] = true
+	}
+	for _, target := range targets {
+		if !seen[target] {
+			t.Errorf("round-robin never picked target %s", target.Addr)
+		}
+	}
+}
+
+func TestPoolPickSkipsUnhealthyTargets(t *testing.T) {
+	down := newTarget("127.0.0.1:1", 1)
+	down.markDown()
+	up := newTarget("127.0.0.1:2", 1)
+	pool := NewPool([]*Target{down, up}, PolicyRoundRobin)
+
+	for i := 0; i < 5; i++ {
+		if got := pool.pick(); got != up {
+			t.Fatalf("pick() = %v, want the only healthy target %v", got, up)
+		}
+	}
+}
+
+func TestPoolPickLeastConnections(t *testing.T) {
+	busy := newTarget("127.0.0.1:1", 1)
+	busy.addConn(5)
+	idle := newTarget("127.0.0.1:2", 1)
+	pool := NewPool([]*Target{busy, idle}, PolicyLeastConnections)
+
+	if got := pool.pick(); got != idle {
+		t.Fatalf("pick() = %v, want the target with fewer active connections %v", got, idle)
+	}
+}
+
+func TestPoolPickReturnsNilWhenAllUnhealthy(t *testing.T) {
+	down := newTarget("127.0.0.1:1", 1)
+	down.markDown()
+	pool := NewPool([]*Target{down}, PolicyRoundRobin)
+
+	if got := pool.pick(); got != nil {
+		t.Fatalf("pick() = %v, want nil when no target is healthy", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Proxy owns the TCP listener and the eBPF objects for the lifetime of
+// the process, and tracks every live HandleConn goroutine so Shutdown can
+// stop accepting, let in-flight kTLS streams drain on their own, and only
+// then unload the eBPF programs. A restart without this draining step
+// tears down the sockmap and drops every in-flight stream.
+type Proxy struct {
+	listener *net.TCPListener
+	objs     *bpfObjects
+	table    *RouteTable
+
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	draining bool
+}
+
+// NewProxy wraps an already-listening TCP listener and loaded eBPF
+// objects.
+func NewProxy(listener *net.TCPListener, objs *bpfObjects, table *RouteTable) *Proxy {
+	return &Proxy{listener: listener, objs: objs, table: table}
+}
+
+// Serve accepts connections, dispatching each to HandleConn, until the
+// listener is closed by Shutdown.
+func (p *Proxy) Serve() {
+	for {
+		inconn, err := p.listener.AcceptTCP()
+		if err != nil {
+			if p.isDraining() {
+				return
+			}
+			slog.Error("accepting connection", "error", err)
+			os.Exit(1)
+		}
+
+		if !p.track() {
+			// Shutdown set draining and may already be past wg.Wait();
+			// dispatching this connection now would race Add against a
+			// Wait that could observe a zero counter. Refuse it instead.
+			inconn.Close()
+			continue
+		}
+
+		metricAcceptedConns.Inc()
+		go func() {
+			defer p.wg.Done()
+			HandleConn(inconn, p.objs.HashMap, p.table)
+		}()
+	}
+}
+
+func (p *Proxy) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+// track registers a new in-flight connection with the drain WaitGroup,
+// unless the proxy is already draining. The Add and the draining check
+// happen under the same lock as Shutdown's draining=true assignment, so a
+// connection can never be added after Shutdown has started (and possibly
+// finished) waiting on p.wg.
+func (p *Proxy) track() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.wg.Add(1)
+	return true
+}
+
+// Shutdown stops accepting new connections, then waits up to deadline for
+// the active HandleConn goroutines to return on their own (i.e. for their
+// EPOLLRDHUP to fire; each deletes its own sockmap entries as it returns)
+// before unloading the eBPF programs. Shutdown deletes no sockmap entries
+// itself: entries of connections still active at the deadline are left in
+// the map when the eBPF objects are closed. It never closes in-flight
+// connections itself, so no stream is cut before the deadline.
+func (p *Proxy) Shutdown(deadline time.Duration) {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+	p.listener.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		slog.Info("all connections drained")
+	case <-time.After(deadline):
+		slog.Warn("shutdown deadline reached with connections still active; unloading eBPF programs anyway")
+	}
+
+	p.objs.Close()
+}
+
+// WaitForShutdownSignal blocks until the process receives SIGINT or
+// SIGTERM.
+func WaitForShutdownSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	signal.Stop(sigs)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignals reloads table whenever the process receives SIGHUP,
+// so operators can add/remove backends without restarting the proxy (a
+// restart would tear down the eBPF sockmap and drop every in-flight
+// stream).
+func watchReloadSignals(table *RouteTable) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			if err := table.Reload(); err != nil {
+				slog.Error("SIGHUP reload failed", "error", err)
+				continue
+			}
+			slog.Info("route table reloaded via SIGHUP")
+		}
+	}()
+}
+
+// serveAdminSocket listens on a unix socket at path and triggers a route
+// table reload for every "reload\n" line received, replying "ok" or
+// "error: <msg>". It is an alternative to SIGHUP for environments where
+// sending signals is inconvenient (e.g. containers without a shared PID
+// namespace).
+func serveAdminSocket(path string, table *RouteTable) error {
+	_ = os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("reload: listening on admin socket %s: %w", path, err)
+	}
+
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				slog.Error("admin socket accept failed", "error", err)
+				return
+			}
+			go handleAdminConn(conn, table)
+		}
+	}()
+	return nil
+}
+
+func handleAdminConn(conn net.Conn, table *RouteTable) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "reload":
+			if err := table.Reload(); err != nil {
+				fmt.Fprintf(conn, "error: %v\n", err)
+				continue
+			}
+			fmt.Fprintln(conn, "ok")
+		default:
+			fmt.Fprintln(conn, "error: unknown command")
+		}
+	}
+}
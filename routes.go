@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoRoute is returned when no route matches a given SNI host and no
+// default route is configured.
+var ErrNoRoute = errors.New("routes: no matching route and no default upstream")
+
+// TargetConfig is a single weighted upstream within a route's pool.
+type TargetConfig struct {
+	Addr   string `json:"addr" yaml:"addr"`
+	Weight int    `json:"weight" yaml:"weight"`
+}
+
+// RouteConfig is a single entry in the on-disk route table. Host may be an
+// exact match ("a.example.com") or a wildcard suffix ("*.example.com").
+// An empty Host marks the default route used when nothing else matches.
+type RouteConfig struct {
+	Host        string             `json:"host" yaml:"host"`
+	Targets     []TargetConfig     `json:"targets" yaml:"targets"`
+	Policy      Policy             `json:"policy" yaml:"policy"`
+	HealthCheck *HealthCheckConfig `json:"healthCheck" yaml:"healthCheck"`
+	CertFile    string             `json:"certFile" yaml:"certFile"`
+	KeyFile     string             `json:"keyFile" yaml:"keyFile"`
+}
+
+// TableConfig is the top-level shape of the route table file.
+type TableConfig struct {
+	Routes []RouteConfig `json:"routes" yaml:"routes"`
+}
+
+// route is the resolved, runtime form of a RouteConfig: the certificate is
+// parsed once at load time so GetCertificate never touches disk.
+type route struct {
+	host     string
+	wildcard bool
+	pool     *Pool
+	cert     *tls.Certificate
+	stopHC   chan struct{}
+}
+
+// RouteTable maps SNI hostnames to upstream addresses and per-route TLS
+// certificates. It is safe for concurrent use; Lookup and GetCertificate
+// are called from every accepted connection while Reload swaps the table
+// out from under them.
+type RouteTable struct {
+	mu    sync.RWMutex
+	exact map[string]*route
+	wild  []*route // suffix-matched, longest suffix first
+	def   *route
+	path  string
+}
+
+// LoadRouteTable reads and parses the route table at path. The format
+// (YAML or JSON) is chosen from the file extension.
+func LoadRouteTable(path string) (*RouteTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("routes: reading %s: %w", path, err)
+	}
+
+	var cfg TableConfig
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	default:
+		return nil, fmt.Errorf("routes: unsupported extension %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("routes: parsing %s: %w", path, err)
+	}
+
+	table := &RouteTable{path: path}
+	if err := table.apply(cfg); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Reload re-reads the table's source file and atomically swaps in the new
+// routes. Existing connections keep using the pool/target they were
+// dispatched with; only subsequent Lookup/GetCertificate calls observe
+// the change. The health checkers of the replaced routes are stopped.
+func (t *RouteTable) Reload() error {
+	fresh, err := LoadRouteTable(t.path)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	old := t.allRoutes()
+	t.exact = fresh.exact
+	t.wild = fresh.wild
+	t.def = fresh.def
+	t.mu.Unlock()
+
+	for _, r := range old {
+		if r.stopHC != nil {
+			close(r.stopHC)
+		}
+	}
+	return nil
+}
+
+// allRoutes returns every route currently installed. Callers must hold t.mu.
+func (t *RouteTable) allRoutes() []*route {
+	all := make([]*route, 0, len(t.exact)+len(t.wild)+1)
+	for _, r := range t.exact {
+		all = append(all, r)
+	}
+	all = append(all, t.wild...)
+	if t.def != nil {
+		all = append(all, t.def)
+	}
+	return all
+}
+
+func (t *RouteTable) apply(cfg TableConfig) error {
+	exact := make(map[string]*route)
+	var wild []*route
+	var def *route
+
+	for _, rc := range cfg.Routes {
+		if len(rc.Targets) == 0 {
+			return fmt.Errorf("routes: route for host %q has no targets", rc.Host)
+		}
+
+		targets := make([]*Target, 0, len(rc.Targets))
+		for _, tc := range rc.Targets {
+			targets = append(targets, newTarget(tc.Addr, tc.Weight))
+		}
+
+		r := &route{pool: NewPool(targets, rc.Policy)}
+		if rc.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(rc.CertFile, rc.KeyFile)
+			if err != nil {
+				return fmt.Errorf("routes: loading cert for host %q: %w", rc.Host, err)
+			}
+			r.cert = &cert
+		}
+		if rc.HealthCheck != nil {
+			r.stopHC = make(chan struct{})
+			startHealthChecker(r.pool, *rc.HealthCheck, r.stopHC)
+		}
+
+		switch {
+		case rc.Host == "":
+			def = r
+		case strings.HasPrefix(rc.Host, "*."):
+			r.host = strings.TrimPrefix(rc.Host, "*")
+			r.wildcard = true
+			wild = append(wild, r)
+		default:
+			r.host = rc.Host
+			exact[rc.Host] = r
+		}
+	}
+
+	// Longest suffix first so "*.api.example.com" is preferred over
+	// "*.example.com" when both match.
+	sortRoutesBySuffixLen(wild)
+
+	t.mu.Lock()
+	t.exact = exact
+	t.wild = wild
+	t.def = def
+	t.mu.Unlock()
+	return nil
+}
+
+func sortRoutesBySuffixLen(routes []*route) {
+	for i := 1; i < len(routes); i++ {
+		for j := i; j > 0 && len(routes[j].host) > len(routes[j-1].host); j-- {
+			routes[j], routes[j-1] = routes[j-1], routes[j]
+		}
+	}
+}
+
+// Lookup returns the route matching sni, falling back to the default route.
+// It returns ErrNoRoute if nothing matches and no default is configured.
+func (t *RouteTable) Lookup(sni string) (*route, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	sni = strings.ToLower(sni)
+	if r, ok := t.exact[sni]; ok {
+		return r, nil
+	}
+	for _, r := range t.wild {
+		if strings.HasSuffix(sni, r.host) {
+			return r, nil
+		}
+	}
+	if t.def != nil {
+		return t.def, nil
+	}
+	return nil, ErrNoRoute
+}
+
+// GetCertificate implements the signature expected by tls.Config so a
+// single listener can serve distinct certificates per virtual host.
+func (t *RouteTable) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r, err := t.Lookup(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if r.cert == nil {
+		return nil, fmt.Errorf("routes: no certificate configured for host %q", hello.ServerName)
+	}
+	return r.cert, nil
+}
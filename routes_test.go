@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestRoute(host string, wildcard bool) *route {
+	return &route{
+		host:     host,
+		wildcard: wildcard,
+		pool:     NewPool([]*Target{newTarget("127.0.0.1:0", 1)}, PolicyRoundRobin),
+	}
+}
+
+func TestRouteTableLookupPrecedence(t *testing.T) {
+	exactRoute := newTestRoute("a.example.com", false)
+	wildRoute := newTestRoute(".example.com", true)
+	wildAPIRoute := newTestRoute(".api.example.com", true)
+	defRoute := newTestRoute("", false)
+
+	table := &RouteTable{
+		exact: map[string]*route{"a.example.com": exactRoute},
+		wild:  []*route{wildAPIRoute, wildRoute}, // pre-sorted, longest suffix first
+		def:   defRoute,
+	}
+
+	tests := []struct {
+		name string
+		sni  string
+		want *route
+	}{
+		{"exact match wins over wildcard", "a.example.com", exactRoute},
+		{"exact match is case-insensitive", "A.Example.Com", exactRoute},
+		{"longest matching wildcard suffix wins", "v1.api.example.com", wildAPIRoute},
+		{"shorter wildcard suffix still matches", "other.example.com", wildRoute},
+		{"no match falls back to default", "unrelated.test", defRoute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := table.Lookup(tt.sni)
+			if err != nil {
+				t.Fatalf("Lookup(%q) returned error: %v", tt.sni, err)
+			}
+			if got != tt.want {
+				t.Errorf("Lookup(%q) = %v, want %v", tt.sni, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTableLookupNoRoute(t *testing.T) {
+	table := &RouteTable{exact: map[string]*route{}}
+
+	_, err := table.Lookup("nothing.test")
+	if !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("Lookup() error = %v, want ErrNoRoute", err)
+	}
+}